@@ -0,0 +1,129 @@
+package flasher
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/ulikunitz/xz"
+)
+
+// magic bytes used to detect compressed sources regardless of file
+// extension - the candidates returned by imageutils.GetImageFilesInCurrentDir
+// and anything passed in FlashConfig.Image are sniffed the same way.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic   = []byte{0x50, 0x4b, 0x03, 0x04}
+)
+
+// decompressedImage wraps a source image.Image so that callers see the
+// decompressed byte stream while still closing the original handle.
+type decompressedImage struct {
+	source image.Image
+	reader io.Reader
+}
+
+func (d *decompressedImage) Read(p []byte) (int, error) { return d.reader.Read(p) }
+
+// Close closes both the decompressor (notably *zstd.Decoder, which otherwise
+// leaks its background goroutines, and a zip.File's reader handle) and the
+// underlying source, reporting the first error encountered.
+func (d *decompressedImage) Close() error {
+	var closeErr error
+	if c, ok := d.reader.(io.Closer); ok {
+		closeErr = c.Close()
+	}
+	if err := d.source.Close(); closeErr == nil {
+		closeErr = err
+	}
+	return closeErr
+}
+
+// wrapDecompressor sniffs the first few bytes of src for a known compression
+// magic number and, if found, returns src wrapped with the matching streaming
+// decompressor. If src isn't recognized as compressed it is returned as-is
+// (aside from the bufio.Reader used to do the sniffing), so CopyWithProgress
+// always ends up writing raw image bytes to the device.
+func wrapDecompressor(src image.Image) (image.Image, error) {
+	br := bufio.NewReader(src)
+	header, _ := br.Peek(6)
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		r, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening gzip stream: %w", err)
+		}
+		return &decompressedImage{source: src, reader: r}, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return &decompressedImage{source: src, reader: bzip2.NewReader(br)}, nil
+	case bytes.HasPrefix(header, xzMagic):
+		r, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening xz stream: %w", err)
+		}
+		return &decompressedImage{source: src, reader: r}, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		r, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening zstd stream: %w", err)
+		}
+		return &decompressedImage{source: src, reader: r.IOReadCloser()}, nil
+	case bytes.HasPrefix(header, zipMagic):
+		return wrapZip(src, br)
+	default:
+		return &decompressedImage{source: src, reader: br}, nil
+	}
+}
+
+// wrapZip picks the largest regular file entry in a zip-wrapped image and
+// streams it out. Zip's central directory lives at the end of the file, so
+// unlike the other formats this requires random access to src rather than a
+// pure streaming reader.
+func wrapZip(src image.Image, br *bufio.Reader) (image.Image, error) {
+	ra, ok := src.(io.ReaderAt)
+	seeker, okSeek := src.(io.Seeker)
+	if !ok || !okSeek {
+		return nil, fmt.Errorf("zip-wrapped image source does not support random access")
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("determining zip source size: %w", err)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("rewinding zip source: %w", err)
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, fmt.Errorf("opening zip archive: %w", err)
+	}
+
+	var largest *zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if largest == nil || f.UncompressedSize64 > largest.UncompressedSize64 {
+			largest = f
+		}
+	}
+	if largest == nil {
+		return nil, fmt.Errorf("no regular file found in zip archive")
+	}
+
+	rc, err := largest.Open()
+	if err != nil {
+		return nil, fmt.Errorf("opening %s in zip archive: %w", largest.Name, err)
+	}
+	return &decompressedImage{source: src, reader: rc}, nil
+}
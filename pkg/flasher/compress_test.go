@@ -0,0 +1,71 @@
+package flasher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+// memImage is a minimal image.Image backed by an in-memory byte slice, used
+// to exercise wrapDecompressor without touching a real file.
+type memImage struct {
+	*bytes.Reader
+	closed bool
+}
+
+func newMemImage(data []byte) *memImage { return &memImage{Reader: bytes.NewReader(data)} }
+
+func (m *memImage) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestWrapDecompressorGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte("hello image bytes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src := newMemImage(buf.Bytes())
+	img, err := wrapDecompressor(src)
+	if err != nil {
+		t.Fatalf("wrapDecompressor: %v", err)
+	}
+
+	got, err := io.ReadAll(img)
+	if err != nil {
+		t.Fatalf("reading decompressed stream: %v", err)
+	}
+	if string(got) != "hello image bytes" {
+		t.Errorf("decompressed = %q, want %q", got, "hello image bytes")
+	}
+
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !src.closed {
+		t.Error("wrapDecompressor's Close did not close the underlying source")
+	}
+}
+
+func TestWrapDecompressorPassthrough(t *testing.T) {
+	raw := []byte("not compressed at all")
+	src := newMemImage(raw)
+	img, err := wrapDecompressor(src)
+	if err != nil {
+		t.Fatalf("wrapDecompressor: %v", err)
+	}
+
+	got, err := io.ReadAll(img)
+	if err != nil {
+		t.Fatalf("reading passthrough stream: %v", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Errorf("passthrough = %q, want %q", got, raw)
+	}
+}
@@ -0,0 +1,37 @@
+package flasher
+
+import "testing"
+
+func TestIsRemoteSource(t *testing.T) {
+	cases := []struct {
+		raw    string
+		wantOK bool
+	}{
+		{"http://example.com/image.img", true},
+		{"https://example.com/image.img", true},
+		{"file:///home/user/image.img", true},
+		{"/home/user/image.img", false},
+		{"./image.img", false},
+		{"image.img.xz", false},
+	}
+
+	for _, c := range cases {
+		_, ok := isRemoteSource(c.raw)
+		if ok != c.wantOK {
+			t.Errorf("isRemoteSource(%q) ok = %v, want %v", c.raw, ok, c.wantOK)
+		}
+	}
+}
+
+func TestCacheKeyStableAndCollisionFree(t *testing.T) {
+	a := cacheKey("http://example.com/one.img")
+	b := cacheKey("http://example.com/one.img")
+	c := cacheKey("http://example.com/two.img")
+
+	if a != b {
+		t.Errorf("cacheKey is not stable: %q != %q", a, b)
+	}
+	if a == c {
+		t.Errorf("cacheKey collided for different URLs: %q", a)
+	}
+}
@@ -3,7 +3,6 @@ package flasher
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
 	"errors"
 	"fmt"
 	"hash"
@@ -26,57 +25,125 @@ import (
 const BlockSize = 512
 
 type FlashConfig struct {
+	// Image is a local path, or an http(s):// or file:// URL. Remote images
+	// are downloaded into a local cache keyed by URL before flashing.
 	Image          string
 	Device         string
 	NotInteractive bool
 	Verify         bool
+
+	// HashAlgorithm selects the digest used for Verify and the sidecar file:
+	// one of "md5", "sha1", "sha256", "sha512", "blake3". Defaults to sha256.
+	HashAlgorithm string
+	// ExpectedChecksum, if set, is checked against Image before it is written
+	// to the device, so a corrupt download fails fast instead of bricking a
+	// card. Takes precedence over ChecksumFile.
+	ExpectedChecksum string
+	// ChecksumFile points at a sha256sums-style file ("<hex>  <filename>" per
+	// line) next to Image; used to look up ExpectedChecksum when it isn't set
+	// directly.
+	ChecksumFile string
+
+	// WriteTimeout, if set, bounds each device write pass and each verify
+	// pass separately, so a hung USB adapter aborts instead of blocking
+	// forever. Downloads and interactive prompts are not bounded by it. Zero
+	// means no timeout.
+	WriteTimeout time.Duration
+
+	// Devices, if set, flashes all of the listed devices concurrently from
+	// the same source image instead of just Device. AllDetachable does the
+	// same for every detachable device currently present.
+	Devices       []string
+	AllDetachable bool
+
+	// First-boot customization, applied by mounting the freshly written FAT
+	// boot partition after Flash and dropping the usual Raspberry Pi
+	// headless-provisioning files into it.
+	EnableSSH bool
+
+	WifiSSID    string
+	WifiPSK     string
+	WifiCountry string
+
+	// UserConf is a "username:hashed-password" line for userconf.txt.
+	UserConf string
+
+	// CloudInitUserData / CloudInitMetaData are each either a path to read or
+	// inline YAML to write verbatim as cloud-init's user-data / meta-data.
+	CloudInitUserData string
+	CloudInitMetaData string
+
+	// ExtraBootFiles maps boot-partition-relative destination paths to a
+	// source path (or inline contents) to copy in, for anything not covered
+	// by the fields above.
+	ExtraBootFiles map[string]string
 }
 
 type Flasher interface {
 	Flash() error
-	// Verify() error
+	// Verify re-reads the configured device against the sidecar file written
+	// by a previous successful Flash, without needing the original image.
+	Verify() error
 }
 
 type flasher struct {
 	config      FlashConfig
 	ui          packer.Ui
 	imageOpener image.ImageOpener
+	ctx         context.Context
 }
 
 type FlashResult struct {
+	Device       string
 	Sum          []byte
 	BytesWritten uint64
+	Err          error
 }
 
-var newHasher = md5.New
-
 func NewFlasher(ui packer.Ui, cfg FlashConfig) Flasher {
 	return &flasher{config: cfg, ui: ui, imageOpener: image.NewImageOpener(ui)}
 }
 
+func (f *flasher) hashAlgorithm() string {
+	if f.config.HashAlgorithm == "" {
+		return defaultHashAlgorithm
+	}
+	return f.config.HashAlgorithm
+}
+
 func (f *flasher) Flash() error {
 
+	ctx, cancel := f.newRunContext()
+	f.ctx = ctx
+	defer cancel()
+
 	imageToFlash, err := f.getSource()
 	if err != nil {
 		return err
 	}
 	defer imageToFlash.Close()
 
-	dev, err := f.getDevice()
+	devices, err := f.getDevices()
 	if err != nil {
 		return err
 	}
 
-	f.ui.Say(fmt.Sprintf("Going to flash to %s.", dev.Device))
-	if !f.config.NotInteractive {
-		answer, err := f.ui.Ask("Are you sure?")
-		if err != nil {
-			return err
+	if len(devices) > 1 {
+		names := make([]string, len(devices))
+		for i, d := range devices {
+			names[i] = d.Device
 		}
-		answer = strings.TrimSpace(strings.ToLower(answer))
-		if !strings.HasPrefix("yes", answer) {
-			return errors.New("canceled by user")
+		f.ui.Say(fmt.Sprintf("Going to flash to %s.", strings.Join(names, ", ")))
+		if err := f.confirm(); err != nil {
+			return err
 		}
+		return f.flashAll(imageToFlash, devices)
+	}
+	dev := devices[0]
+
+	f.ui.Say(fmt.Sprintf("Going to flash to %s.", dev.Device))
+	if err := f.confirm(); err != nil {
+		return err
 	}
 
 	err = f.unmount(dev)
@@ -85,21 +152,76 @@ func (f *flasher) Flash() error {
 	}
 	res, err := f.flash(imageToFlash, dev)
 	if err != nil {
+		if isCancellation(err) {
+			f.abandonDevice(dev)
+		}
 		return err
 	}
 
 	syscall.Sync()
 
 	if len(res.Sum) != 0 {
-		f.verify(*res, dev)
+		if err := f.verify(*res, dev); err != nil {
+			if isCancellation(err) {
+				f.abandonDevice(dev)
+			}
+			return err
+		}
+	}
+
+	if len(f.config.Image) != 0 && len(res.Sum) != 0 {
+		if err := writeSidecar(f.config.Image, f.hashAlgorithm(), *res); err != nil {
+			f.ui.Error(fmt.Sprintf("writing checksum sidecar: %s", err))
+		}
+	}
+
+	// Customization is applied last: it writes into the boot partition's
+	// byte range, which verify above just hashed against the raw image -
+	// doing this any earlier would make a good flash fail verification.
+	if err := f.applyFirstBootCustomization(dev); err != nil {
+		f.ui.Error(fmt.Sprintf("applying first-boot customization: %s", err))
 	}
 
 	return nil
 }
 
+// confirm asks the user to approve the flash that was just described via
+// f.ui.Say, unless NotInteractive is set.
+func (f *flasher) confirm() error {
+	if f.config.NotInteractive {
+		return nil
+	}
+	answer, err := f.ask("Are you sure?")
+	if err != nil {
+		return err
+	}
+	answer = strings.TrimSpace(strings.ToLower(answer))
+	if !strings.HasPrefix("yes", answer) {
+		return errors.New("canceled by user")
+	}
+	return nil
+}
+
 func (f *flasher) getSource() (image.Image, error) {
 	if len(f.config.Image) != 0 {
-		return f.imageOpener.Open(f.config.Image)
+		path := f.config.Image
+		if u, ok := isRemoteSource(path); ok {
+			fetched, err := f.fetchSource(u)
+			if err != nil {
+				return nil, err
+			}
+			path = fetched
+		}
+
+		img, err := f.imageOpener.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.verifySourceChecksum(path, img); err != nil {
+			img.Close()
+			return nil, err
+		}
+		return wrapDecompressor(img)
 	}
 
 	potentials := imageutils.GetImageFilesInCurrentDir()
@@ -120,7 +242,11 @@ func (f *flasher) getSource() (image.Image, error) {
 		return nil, err
 	}
 	f.ui.Say("using image " + chosen)
-	return f.imageOpener.Open(chosen)
+	img, err := f.imageOpener.Open(chosen)
+	if err != nil {
+		return nil, err
+	}
+	return wrapDecompressor(img)
 }
 
 func (f *flasher) getMostRecent(files []string) (string, error) {
@@ -151,7 +277,7 @@ func (f *flasher) Choose(files []string) (string, error) {
 		images += fmt.Sprintf("%d. %s\n", i+1, f)
 	}
 
-	answer, err := f.ui.Ask(images + "Which image should we use (type number)?")
+	answer, err := f.ask(images + "Which image should we use (type number)?")
 	if err != nil {
 		return "", err
 	}
@@ -201,18 +327,23 @@ func (f *flasher) flash(input image.Image, device *utils.Device) (*FlashResult,
 	}
 	defer output.Close()
 
-	// TODO : support signals
-	ctx := context.Background()
-
 	var checksummer hash.Hash
 	var outputWriter io.Writer = output
 
 	if f.config.Verify {
-		checksummer = newHasher()
+		checksummer, err = newHasher(f.hashAlgorithm())
+		if err != nil {
+			return nil, err
+		}
 		outputWriter = io.MultiWriter(output, checksummer)
 	}
 
+	ctx, cancel := f.writeContext()
+	defer cancel()
 	totaldata, err := utils.CopyWithProgress(ctx, f.ui, outputWriter, input)
+	if err != nil {
+		return nil, err
+	}
 
 	res := FlashResult{BytesWritten: uint64(totaldata)}
 	if checksummer != nil {
@@ -229,15 +360,18 @@ func (f *flasher) verify(res FlashResult, dev *utils.Device) error {
 		return err
 	}
 	defer input.Close()
-	checksummer := newHasher()
+	checksummer, err := newHasher(f.hashAlgorithm())
+	if err != nil {
+		return err
+	}
 
 	limitedInput := &io.LimitedReader{
 		R: input,
 		N: int64(res.BytesWritten),
 	}
 
-	// TODO : support signals
-	ctx := context.Background()
+	ctx, cancel := f.writeContext()
+	defer cancel()
 	_, err = utils.CopyWithProgress(ctx, f.ui, checksummer, limitedInput)
 
 	if err != nil {
@@ -251,6 +385,31 @@ func (f *flasher) verify(res FlashResult, dev *utils.Device) error {
 	return nil
 }
 
+// Verify re-reads the configured device and compares it against the sidecar
+// file written by a previous successful Flash, without needing the original
+// image on disk.
+func (f *flasher) Verify() error {
+	ctx, cancel := f.newRunContext()
+	f.ctx = ctx
+	defer cancel()
+
+	dev, err := f.getDevice()
+	if err != nil {
+		return err
+	}
+
+	res, err := readSidecar(f.sidecarPath())
+	if err != nil {
+		return err
+	}
+
+	return f.verify(res, dev)
+}
+
+func (f *flasher) sidecarPath() string {
+	return sidecarPathFor(f.config.Image, f.hashAlgorithm())
+}
+
 func (f *flasher) getDevice() (*utils.Device, error) {
 
 	detachables, err := utils.GetDetachableDevices()
@@ -282,7 +441,7 @@ func (f *flasher) getDevice() (*utils.Device, error) {
 	for i, d := range detachables {
 		question += fmt.Sprintf("%d. %s (%s)\n", i+1, d.Device, d.Name)
 	}
-	answer, err := f.ui.Ask(question)
+	answer, err := f.ask(question)
 	if err != nil {
 		return nil, err
 	}
@@ -296,4 +455,4 @@ func (f *flasher) getDevice() (*utils.Device, error) {
 	}
 	return &detachables[i], nil
 
-}
\ No newline at end of file
+}
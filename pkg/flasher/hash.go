@@ -0,0 +1,151 @@
+package flasher
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/zeebo/blake3"
+)
+
+const defaultHashAlgorithm = "sha256"
+
+// newHasher returns a fresh hash.Hash for the given algorithm name, one of
+// "md5", "sha1", "sha256", "sha512" or "blake3". An empty name selects
+// defaultHashAlgorithm.
+func newHasher(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "", defaultHashAlgorithm:
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake3":
+		return blake3.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+}
+
+// verifySourceChecksum hashes img with the configured algorithm and compares
+// it against FlashConfig.ExpectedChecksum (or a lookup in ChecksumFile),
+// rewinding img afterwards so it can still be flashed. It is a no-op if
+// neither is configured.
+func (f *flasher) verifySourceChecksum(path string, img image.Image) error {
+	expected, algo, err := f.expectedSourceChecksum(path)
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		return nil
+	}
+
+	h, err := newHasher(algo)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, img); err != nil {
+		return fmt.Errorf("hashing %s: %w", path, err)
+	}
+
+	seeker, ok := img.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("%s does not support rewinding after checksum verification", path)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("rewinding %s after checksum verification: %w", path, err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, expected) {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", path, expected, got)
+	}
+	f.ui.Say(fmt.Sprintf("checksum OK for %s (%s)", path, algo))
+	return nil
+}
+
+// expectedSourceChecksum resolves the checksum FlashConfig expects path to
+// have, preferring ExpectedChecksum over a ChecksumFile lookup.
+func (f *flasher) expectedSourceChecksum(path string) (checksum, algo string, err error) {
+	algo = f.hashAlgorithm()
+
+	if f.config.ExpectedChecksum != "" {
+		return f.config.ExpectedChecksum, algo, nil
+	}
+	if f.config.ChecksumFile == "" {
+		return "", algo, nil
+	}
+
+	data, err := os.ReadFile(f.config.ChecksumFile)
+	if err != nil {
+		return "", algo, fmt.Errorf("reading checksum file %s: %w", f.config.ChecksumFile, err)
+	}
+
+	base := filepath.Base(path)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == base {
+			return fields[0], algo, nil
+		}
+	}
+	return "", algo, fmt.Errorf("no checksum for %s found in %s", base, f.config.ChecksumFile)
+}
+
+// writeSidecar records res next to imagePath as "<imagePath>.flashed.<algo>"
+// so operators can later audit which bits a device received without keeping
+// the original image around.
+func writeSidecar(imagePath, algo string, res FlashResult) error {
+	return writeSidecarAt(sidecarPathFor(imagePath, algo), algo, res)
+}
+
+func writeSidecarAt(path, algo string, res FlashResult) error {
+	contents := fmt.Sprintf("%s  bytes-written=%d  algo=%s\n", hex.EncodeToString(res.Sum), res.BytesWritten, algo)
+	return os.WriteFile(path, []byte(contents), 0644)
+}
+
+// readSidecar parses a sidecar file previously written by writeSidecar.
+func readSidecar(path string) (FlashResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FlashResult{}, fmt.Errorf("reading sidecar %s: %w", path, err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return FlashResult{}, fmt.Errorf("malformed sidecar %s", path)
+	}
+
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return FlashResult{}, fmt.Errorf("malformed checksum in sidecar %s: %w", path, err)
+	}
+
+	bytesWritten, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "bytes-written="), 10, 64)
+	if err != nil {
+		return FlashResult{}, fmt.Errorf("malformed bytes-written in sidecar %s: %w", path, err)
+	}
+
+	return FlashResult{Sum: sum, BytesWritten: bytesWritten}, nil
+}
+
+func sidecarPathFor(imagePath, algo string) string {
+	return fmt.Sprintf("%s.flashed.%s", imagePath, algo)
+}
+
+// sidecarPathForDevice namespaces a multi-device sidecar by the target
+// device, since several devices share the same source imagePath.
+func sidecarPathForDevice(imagePath, algo, device string) string {
+	return fmt.Sprintf("%s.flashed.%s.%s", imagePath, algo, filepath.Base(device))
+}
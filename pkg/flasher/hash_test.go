@@ -0,0 +1,57 @@
+package flasher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewHasher(t *testing.T) {
+	for _, algo := range []string{"", "sha256", "md5", "sha1", "sha512", "blake3"} {
+		if _, err := newHasher(algo); err != nil {
+			t.Errorf("newHasher(%q): %v", algo, err)
+		}
+	}
+
+	if _, err := newHasher("crc32"); err == nil {
+		t.Error("newHasher(\"crc32\"): expected error, got nil")
+	}
+}
+
+func TestWriteSidecarAtReadSidecarRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.img.flashed.sha256")
+	res := FlashResult{Sum: []byte{0xde, 0xad, 0xbe, 0xef}, BytesWritten: 123456}
+
+	if err := writeSidecarAt(path, "sha256", res); err != nil {
+		t.Fatalf("writeSidecarAt: %v", err)
+	}
+
+	got, err := readSidecar(path)
+	if err != nil {
+		t.Fatalf("readSidecar: %v", err)
+	}
+	if string(got.Sum) != string(res.Sum) {
+		t.Errorf("Sum = %x, want %x", got.Sum, res.Sum)
+	}
+	if got.BytesWritten != res.BytesWritten {
+		t.Errorf("BytesWritten = %d, want %d", got.BytesWritten, res.BytesWritten)
+	}
+}
+
+func TestReadSidecarMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.flashed.sha256")
+	if err := os.WriteFile(path, []byte("not a sidecar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSidecar(path); err == nil {
+		t.Error("readSidecar: expected error for malformed sidecar, got nil")
+	}
+}
+
+func TestSidecarPathForDevice(t *testing.T) {
+	got := sidecarPathForDevice("/tmp/image.img", "sha256", "/dev/sdb")
+	want := "/tmp/image.img.flashed.sha256.sdb"
+	if got != want {
+		t.Errorf("sidecarPathForDevice = %q, want %q", got, want)
+	}
+}
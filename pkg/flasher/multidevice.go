@@ -0,0 +1,230 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/solo-io/packer-builder-arm-image/pkg/image"
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// getDevices resolves FlashConfig.Devices / AllDetachable into the set of
+// devices to flash. With neither set it falls back to the single-device
+// selection in getDevice.
+func (f *flasher) getDevices() ([]*utils.Device, error) {
+	if !f.config.AllDetachable && len(f.config.Devices) == 0 {
+		dev, err := f.getDevice()
+		if err != nil {
+			return nil, err
+		}
+		return []*utils.Device{dev}, nil
+	}
+
+	detachables, err := utils.GetDetachableDevices()
+	if err != nil {
+		return nil, err
+	}
+	if len(detachables) == 0 {
+		return nil, errors.New("no devices")
+	}
+
+	if f.config.AllDetachable {
+		devices := make([]*utils.Device, len(detachables))
+		for i := range detachables {
+			devices[i] = &detachables[i]
+		}
+		return devices, nil
+	}
+
+	devices := make([]*utils.Device, 0, len(f.config.Devices))
+	for _, want := range f.config.Devices {
+		found := false
+		for i, d := range detachables {
+			if d.Device == want {
+				devices = append(devices, &detachables[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("configured device %s not found", want)
+		}
+	}
+	return devices, nil
+}
+
+// deviceTarget tracks the state of a single device within a multi-device
+// flash: once err is set the target is considered dead and is skipped by
+// further writes, but live targets keep going.
+type deviceTarget struct {
+	dev         *utils.Device
+	file        *os.File
+	checksummer hash.Hash
+	err         error
+}
+
+// multiDeviceWriter fans a single input stream out to several devices. A
+// write failure on one target is recorded and that target is dropped from
+// subsequent writes instead of aborting the whole copy, so one bad card
+// doesn't stop the others from being flashed.
+type multiDeviceWriter struct {
+	targets []*deviceTarget
+	ui      packer.Ui
+}
+
+func (w *multiDeviceWriter) Write(p []byte) (int, error) {
+	alive := false
+	for _, t := range w.targets {
+		if t.err != nil {
+			continue
+		}
+		var dst io.Writer = t.file
+		if t.checksummer != nil {
+			dst = io.MultiWriter(t.file, t.checksummer)
+		}
+		if _, err := dst.Write(p); err != nil {
+			t.err = err
+			w.ui.Error(fmt.Sprintf("writing to %s: %s - continuing with remaining devices", t.dev.Device, err))
+			continue
+		}
+		alive = true
+	}
+	if !alive {
+		return 0, errors.New("all devices failed")
+	}
+	return len(p), nil
+}
+
+// flashAll unmounts and opens each device, writes them all in one pass from
+// the same decompressed image and then verifies them in parallel,
+// aggregating per-device results. A failure on one device is reported but
+// doesn't stop the others; the returned error (if any) enumerates which
+// devices failed.
+func (f *flasher) flashAll(input image.Image, devices []*utils.Device) error {
+	targets := make([]*deviceTarget, 0, len(devices))
+	for _, dev := range devices {
+		t := &deviceTarget{dev: dev}
+		targets = append(targets, t)
+		if err := f.unmount(dev); err != nil {
+			t.err = fmt.Errorf("unmounting %s: %w", dev.Device, err)
+		} else if t.file, err = os.OpenFile(dev.Device, os.O_RDWR, 0); err != nil {
+			t.err = fmt.Errorf("opening %s: %w", dev.Device, err)
+		} else {
+			defer t.file.Close()
+		}
+		if t.err != nil {
+			f.ui.Error(fmt.Sprintf("%s - continuing with remaining devices", t.err))
+			continue
+		}
+
+		if f.config.Verify {
+			var err error
+			t.checksummer, err = newHasher(f.hashAlgorithm())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	writer := &multiDeviceWriter{targets: targets, ui: f.ui}
+	ctx, cancel := f.writeContext()
+	defer cancel()
+	totalData, err := utils.CopyWithProgress(ctx, f.ui, writer, input)
+	if err != nil {
+		if isCancellation(err) {
+			for _, t := range targets {
+				f.abandonDevice(t.dev)
+			}
+		}
+		return err
+	}
+
+	syscall.Sync()
+
+	results := make([]FlashResult, len(targets))
+	for i, t := range targets {
+		results[i] = FlashResult{Device: t.dev.Device, BytesWritten: uint64(totalData), Err: t.err}
+		if t.checksummer != nil {
+			results[i].Sum = t.checksummer.Sum(nil)
+		}
+	}
+
+	if f.config.Verify {
+		f.verifyAll(results, targets)
+	}
+
+	if len(f.config.Image) != 0 {
+		for _, res := range results {
+			if res.Err != nil || len(res.Sum) == 0 {
+				continue
+			}
+			path := sidecarPathForDevice(f.config.Image, f.hashAlgorithm(), res.Device)
+			if err := writeSidecarAt(path, f.hashAlgorithm(), res); err != nil {
+				f.ui.Error(fmt.Sprintf("writing checksum sidecar for %s: %s", res.Device, err))
+			}
+		}
+	}
+
+	// Customization is applied last, and skipped for devices that failed the
+	// write or verify: it writes into the boot partition's byte range, which
+	// verify above just hashed against the raw image.
+	for i, t := range targets {
+		if results[i].Err != nil {
+			continue
+		}
+		if err := f.applyFirstBootCustomization(t.dev); err != nil {
+			f.ui.Error(fmt.Sprintf("applying first-boot customization to %s: %s", t.dev.Device, err))
+		}
+	}
+
+	return f.summarizeResults(results)
+}
+
+// verifyAll re-reads every still-healthy device against its recorded
+// checksum, one goroutine per device, recording any mismatch back onto
+// results. All passes report progress through the single shared packer.Ui,
+// so their progress lines interleave on the terminal.
+func (f *flasher) verifyAll(results []FlashResult, targets []*deviceTarget) {
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		if t.err != nil || len(results[i].Sum) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t *deviceTarget) {
+			defer wg.Done()
+			f.ui.Say(fmt.Sprintf("verifying %s", t.dev.Device))
+			if err := f.verify(results[i], t.dev); err != nil {
+				results[i].Err = err
+				if isCancellation(err) {
+					f.abandonDevice(t.dev)
+				}
+			}
+		}(i, t)
+	}
+	wg.Wait()
+}
+
+// summarizeResults reports per-device pass/fail to the UI and returns a
+// single error enumerating the failed devices, or nil if all succeeded.
+func (f *flasher) summarizeResults(results []FlashResult) error {
+	var failed []string
+	for _, res := range results {
+		if res.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", res.Device, res.Err))
+			continue
+		}
+		f.ui.Say(fmt.Sprintf("%s: flashed %d bytes successfully", res.Device, res.BytesWritten))
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("flash failed on %d device(s): %s", len(failed), strings.Join(failed, "; "))
+}
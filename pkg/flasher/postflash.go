@@ -0,0 +1,216 @@
+package flasher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unicode"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// firstBootConfig bundles the post-flash customization options a caller can
+// set on FlashConfig so a freshly written card boots ready to use instead of
+// needing a manual step per card.
+type firstBootConfig struct {
+	EnableSSH bool
+
+	WifiSSID    string
+	WifiPSK     string
+	WifiCountry string
+
+	UserConf string
+
+	CloudInitUserData string
+	CloudInitMetaData string
+
+	ExtraBootFiles map[string]string
+}
+
+func (f *flasher) firstBoot() firstBootConfig {
+	return firstBootConfig{
+		EnableSSH:         f.config.EnableSSH,
+		WifiSSID:          f.config.WifiSSID,
+		WifiPSK:           f.config.WifiPSK,
+		WifiCountry:       f.config.WifiCountry,
+		UserConf:          f.config.UserConf,
+		CloudInitUserData: f.config.CloudInitUserData,
+		CloudInitMetaData: f.config.CloudInitMetaData,
+		ExtraBootFiles:    f.config.ExtraBootFiles,
+	}
+}
+
+func (c firstBootConfig) empty() bool {
+	return !c.EnableSSH && c.WifiSSID == "" && c.UserConf == "" &&
+		c.CloudInitUserData == "" && c.CloudInitMetaData == "" && len(c.ExtraBootFiles) == 0
+}
+
+// applyFirstBootCustomization re-reads dev's partition table, mounts its FAT
+// boot partition and drops the configured files into it - the standard
+// Raspberry Pi "headless provisioning" trick (ssh, wpa_supplicant.conf,
+// userconf.txt, cloud-init user-data/meta-data).
+func (f *flasher) applyFirstBootCustomization(dev *utils.Device) error {
+	cfg := f.firstBoot()
+	if cfg.empty() {
+		return nil
+	}
+
+	if err := exec.Command("partprobe", dev.Device).Run(); err != nil {
+		return fmt.Errorf("re-reading partition table on %s: %w", dev.Device, err)
+	}
+
+	bootPartition, err := firstVfatPartition(dev.Device)
+	if err != nil {
+		return err
+	}
+
+	mountpoint, err := os.MkdirTemp("", "packer-builder-arm-image-boot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountpoint)
+
+	if err := syscall.Mount(bootPartition, mountpoint, "vfat", 0, ""); err != nil {
+		return fmt.Errorf("mounting %s at %s: %w", bootPartition, mountpoint, err)
+	}
+	defer syscall.Unmount(mountpoint, 0)
+
+	if err := cfg.writeTo(mountpoint); err != nil {
+		return err
+	}
+
+	syscall.Sync()
+	f.ui.Say(fmt.Sprintf("wrote first-boot customization to %s", bootPartition))
+	return nil
+}
+
+func (c firstBootConfig) writeTo(mountpoint string) error {
+	if c.EnableSSH {
+		if err := writeBootFile(mountpoint, "ssh", ""); err != nil {
+			return err
+		}
+	}
+
+	if c.WifiSSID != "" {
+		conf, err := wpaSupplicantConf(c.WifiCountry, c.WifiSSID, c.WifiPSK)
+		if err != nil {
+			return err
+		}
+		if err := writeBootFile(mountpoint, "wpa_supplicant.conf", conf); err != nil {
+			return err
+		}
+	}
+
+	if c.UserConf != "" {
+		if err := writeBootFile(mountpoint, "userconf.txt", c.UserConf+"\n"); err != nil {
+			return err
+		}
+	}
+
+	if c.CloudInitUserData != "" {
+		if err := copyOrWriteBootFile(mountpoint, "user-data", c.CloudInitUserData); err != nil {
+			return err
+		}
+	}
+	if c.CloudInitMetaData != "" {
+		if err := copyOrWriteBootFile(mountpoint, "meta-data", c.CloudInitMetaData); err != nil {
+			return err
+		}
+	}
+
+	for dest, src := range c.ExtraBootFiles {
+		if err := copyOrWriteBootFile(mountpoint, dest, src); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyOrWriteBootFile treats value as a source path if it names an existing
+// file and copies it, otherwise writes value itself as the file's contents -
+// so CloudInitUserData etc. can be either a path or inline YAML.
+func copyOrWriteBootFile(mountpoint, dest, value string) error {
+	if data, err := os.ReadFile(value); err == nil {
+		return writeBootFile(mountpoint, dest, string(data))
+	}
+	return writeBootFile(mountpoint, dest, value)
+}
+
+func writeBootFile(mountpoint, dest, contents string) error {
+	full := filepath.Join(mountpoint, dest)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(full, []byte(contents), 0644)
+}
+
+// wpaSupplicantConf renders a minimal wpa_supplicant.conf. ssid and psk are
+// written inside double-quoted fields, so a value containing a quote or a
+// control character (notably a newline) could break out of its field and
+// inject arbitrary extra directives into the file written onto the boot
+// partition - reject rather than risk that.
+func wpaSupplicantConf(country, ssid, psk string) (string, error) {
+	if country == "" {
+		country = "US"
+	}
+	for name, value := range map[string]string{"WifiCountry": country, "WifiSSID": ssid, "WifiPSK": psk} {
+		if err := validateWpaField(name, value); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf(`country=%s
+ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev
+update_config=1
+
+network={
+	ssid="%s"
+	psk="%s"
+}
+`, country, ssid, psk), nil
+}
+
+func validateWpaField(name, value string) error {
+	if strings.ContainsRune(value, '"') || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%s must not contain quotes or control characters", name)
+	}
+	return nil
+}
+
+// firstVfatPartition asks lsblk for device's partition layout and returns the
+// first vfat partition's device node, which on a Raspberry Pi image is the
+// FAT boot partition.
+func firstVfatPartition(device string) (string, error) {
+	out, err := exec.Command("lsblk", "-J", "-o", "PATH,FSTYPE", device).Output()
+	if err != nil {
+		return "", fmt.Errorf("listing partitions on %s: %w", device, err)
+	}
+
+	var parsed struct {
+		BlockDevices []struct {
+			Path     string `json:"path"`
+			FSType   string `json:"fstype"`
+			Children []struct {
+				Path   string `json:"path"`
+				FSType string `json:"fstype"`
+			} `json:"children"`
+		} `json:"blockdevices"`
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return "", fmt.Errorf("parsing lsblk output for %s: %w", device, err)
+	}
+
+	for _, bd := range parsed.BlockDevices {
+		for _, child := range bd.Children {
+			if child.FSType == "vfat" {
+				return child.Path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no vfat partition found on %s", device)
+}
@@ -0,0 +1,50 @@
+package flasher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWpaSupplicantConf(t *testing.T) {
+	conf, err := wpaSupplicantConf("", "my ssid", "my psk")
+	if err != nil {
+		t.Fatalf("wpaSupplicantConf: %v", err)
+	}
+	for _, want := range []string{`country=US`, `ssid="my ssid"`, `psk="my psk"`} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("wpaSupplicantConf missing %q:\n%s", want, conf)
+		}
+	}
+
+	conf, err = wpaSupplicantConf("GB", "ssid", "psk")
+	if err != nil {
+		t.Fatalf("wpaSupplicantConf: %v", err)
+	}
+	if !strings.Contains(conf, `country=GB`) {
+		t.Errorf("wpaSupplicantConf did not honor country:\n%s", conf)
+	}
+}
+
+func TestWpaSupplicantConfRejectsInjection(t *testing.T) {
+	cases := []string{
+		`ssid"}\nnetwork={ssid="evil`,
+		"ssid\r\nextra=line",
+		"ssid\x00null",
+	}
+	for _, ssid := range cases {
+		if _, err := wpaSupplicantConf("US", ssid, "psk"); err == nil {
+			t.Errorf("wpaSupplicantConf(%q): expected error, got nil", ssid)
+		}
+	}
+}
+
+func TestValidateWpaField(t *testing.T) {
+	if err := validateWpaField("WifiSSID", "plain-ssid"); err != nil {
+		t.Errorf("validateWpaField: unexpected error for clean value: %v", err)
+	}
+	for _, bad := range []string{`has"quote`, "has\rcr", "has\nnl", "has\x00nul"} {
+		if err := validateWpaField("WifiSSID", bad); err == nil {
+			t.Errorf("validateWpaField(%q): expected error, got nil", bad)
+		}
+	}
+}
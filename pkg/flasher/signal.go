@@ -0,0 +1,83 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/solo-io/packer-builder-arm-image/pkg/utils"
+)
+
+// BLKRRPART asks the kernel to re-read a block device's partition table; see
+// linux/fs.h. Used after a cancelled write so stale partition mappings for a
+// half-written device don't linger.
+const blkrrpart = 0x125f
+
+// newRunContext builds the context used for the whole Flash/Verify run: it's
+// cancelled on Ctrl-C or SIGTERM. It is deliberately not bounded by
+// FlashConfig.WriteTimeout - that covers only the device write/verify step
+// (see writeContext), not source downloads or interactive prompts.
+func (f *flasher) newRunContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// writeContext bounds a device write or verify pass with
+// FlashConfig.WriteTimeout, so a hung USB adapter aborts instead of blocking
+// forever in CI, without that budget being spent on downloads or prompts.
+func (f *flasher) writeContext() (context.Context, context.CancelFunc) {
+	if f.config.WriteTimeout <= 0 {
+		return f.ctx, func() {}
+	}
+	return context.WithTimeout(f.ctx, f.config.WriteTimeout)
+}
+
+// isCancellation reports whether err stems from the run being interrupted
+// (Ctrl-C/SIGTERM) or from FlashConfig.WriteTimeout expiring - both leave a
+// device mid-write and call for abandonDevice's teardown.
+func isCancellation(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// ask runs a ui.Ask prompt but abandons it as soon as the run context is
+// cancelled, so Ctrl-C during an interactive prompt doesn't leave a device
+// mounted-then-abandoned waiting on stdin.
+func (f *flasher) ask(prompt string) (string, error) {
+	type result struct {
+		answer string
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		answer, err := f.ui.Ask(prompt)
+		ch <- result{answer, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.answer, r.err
+	case <-f.ctx.Done():
+		return "", f.ctx.Err()
+	}
+}
+
+// abandonDevice is run when a flash or verify is cancelled mid-write. It
+// flushes whatever made it to the device and asks the kernel to re-read the
+// partition table, then tells the operator the device is now in an
+// indeterminate state - it does not attempt to make the device bootable
+// again.
+func (f *flasher) abandonDevice(dev *utils.Device) {
+	syscall.Sync()
+
+	if fd, err := os.Open(dev.Device); err == nil {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), blkrrpart, 0)
+		fd.Close()
+		if errno != 0 {
+			f.ui.Error(fmt.Sprintf("re-reading partition table on %s: %s", dev.Device, errno))
+		}
+	}
+
+	f.ui.Error(fmt.Sprintf("flash to %s was cancelled - the device is now in an indeterminate state and should not be used until reflashed", dev.Device))
+}